@@ -18,10 +18,23 @@ import (
 // The flags modify the behavior of this function as follows:
 //  - BFDryRun: The memory chain index will not be pruned and no accept
 //    notification will be sent since the block is not being accepted.
+//  - BFHeaderValidated: checkBlockContext may skip the header-level checks
+//    already proven by the headers-first download.  checkBlockProofOfStake
+//    still runs unconditionally below since it depends on the coinstake
+//    transaction, which headers alone cannot provide.  Callers do not need
+//    to set this flag themselves: maybeAcceptBlock detects it automatically
+//    by checking whether the block's hash was already linked into the chain
+//    graph as a header-only stub by ProcessBlockHeader, and ORs it into the
+//    flags it passes down.
 //
 // The flags are also passed to checkBlockContext and connectBestChain.  See
 // their documentation for how the flags modify their behavior.
-func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTimeSource, flags BehaviorFlags) error {
+//
+// It returns whether or not the block ended up extending the main chain,
+// either directly or via a reorganization that made it the new best tip, as
+// opposed to landing on a side chain.  The returned bool is only valid when
+// the error is nil.
+func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTimeSource, flags BehaviorFlags) (bool, error) {
 	dryRun := flags&BFDryRun == BFDryRun
 
 	// Get a block node for the block previous to this one.  Will be nil
@@ -29,7 +42,7 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTim
 	prevNode, err := b.getPrevNodeFromBlock(block)
 	if err != nil {
 		log.Errorf("getPrevNodeFromBlock: %v", err)
-		return err
+		return false, err
 	}
 
 	// The height of this block is one more than the referenced previous
@@ -40,11 +53,24 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTim
 	}
 	block.SetHeight(blockHeight)
 
+	// If the block's header was already linked into the chain graph as a
+	// header-only stub by ProcessBlockHeader, then checkBlockContext's
+	// header-level checks (PoW/PoS linkage, timestamp ordering, checkpoint
+	// matching) have already been proven true against it during the
+	// headers-first sync, so set BFHeaderValidated rather than requiring
+	// the caller to know that and set it itself.
+	contextFlags := flags
+	if blockHash, shaErr := block.Sha(); shaErr == nil {
+		if _, known := b.index.lookupNode(blockHash); known && !b.index.haveData(blockHash) {
+			contextFlags |= BFHeaderValidated
+		}
+	}
+
 	// The block must pass all of the validation rules which depend on the
 	// position of the block within the block chain.
-	err = b.checkBlockContext(block, prevNode, flags)
+	err = b.checkBlockContext(block, prevNode, contextFlags)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// ppc: verify hash target and signature of coinstake tx
@@ -53,13 +79,13 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTim
 	err = b.checkBlockProofOfStake(block, timeSource)
 	if err != nil {
 		str := fmt.Sprintf("Proof of stake check failed for block %v : %v", block.Sha(), err)
-		return ruleError(ErrProofOfStakeCheck, str)
+		return false, ruleError(ErrProofOfStakeCheck, str)
 	}
 
 	// ppc: populate all ppcoin specific block meta data
 	err = b.addToBlockIndex(block)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Prune block nodes which are no longer needed before creating
@@ -67,7 +93,7 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTim
 	if !dryRun {
 		err = b.pruneBlockNodes()
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
@@ -83,12 +109,19 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTim
 		newNode.workSum.Add(prevNode.workSum, newNode.workSum)
 	}
 
+	// Record the new node in the block index.  This also upgrades any
+	// header-only stub left behind by a headers-first sync to fully
+	// stored now that the block's data has arrived.
+	b.index.addNode(newNode)
+
 	// Connect the passed block to the chain while respecting proper chain
 	// selection according to the chain with the most proof of work.  This
-	// also handles validation of the transaction scripts.
-	err = b.connectBestChain(newNode, block, flags)
+	// also handles validation of the transaction scripts.  The returned
+	// bool reports whether the block extended (or reorganized onto) the
+	// main chain as opposed to a side chain.
+	isMainChain, err := b.connectBestChain(newNode, block, flags)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Notify the caller that the new block was accepted into the block
@@ -98,5 +131,13 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, timeSource MedianTim
 		b.sendNotification(NTBlockAccepted, block)
 	}
 
-	return nil
+	// ppc: once a backfilled block reaches the final checkpoint height
+	// during a headers-first sync, the chain is caught up.  Gate on
+	// isMainChain too: a fast-added block that only lands on a side chain
+	// has not actually caught the main chain up to the checkpoint.
+	if flags&BFFastAdd == BFFastAdd && isMainChain {
+		b.markBackfillComplete(blockHeight)
+	}
+
+	return isMainChain, nil
 }
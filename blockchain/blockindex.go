@@ -0,0 +1,113 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"sync"
+
+	"github.com/ppcsuite/btcwire"
+)
+
+// nodeStatus indicates how much is known about a node's block so far.
+type nodeStatus uint8
+
+const (
+	// statusHeaderOnly means only the block header has been validated and
+	// linked into the chain graph; the block's transaction data has not
+	// been downloaded yet.  This is the state headers-first sync leaves
+	// nodes in via ProcessBlockHeader.
+	statusHeaderOnly nodeStatus = iota
+
+	// statusDataStored means the full block, including its transactions,
+	// has been downloaded and is either held in memory or persisted to
+	// the block database.
+	statusDataStored
+)
+
+// blockIndex provides a concurrent-safe, in-memory index of the tree-shaped
+// graph of known blocks, keyed by block hash.  It owns the node graph that
+// used to live directly on BlockChain as the index and depNodes fields.
+//
+// Headers-first sync means a node can exist in the index purely from its
+// header, before the corresponding full block has ever been downloaded, so
+// the index additionally tracks each node's status to distinguish "known to
+// the chain graph" from "fully downloaded and stored".
+type blockIndex struct {
+	sync.RWMutex
+	index    map[btcwire.ShaHash]*blockNode
+	status   map[btcwire.ShaHash]nodeStatus
+	depNodes map[btcwire.ShaHash][]*blockNode
+}
+
+// newBlockIndex returns an initialized, empty blockIndex.
+func newBlockIndex() *blockIndex {
+	return &blockIndex{
+		index:    make(map[btcwire.ShaHash]*blockNode),
+		status:   make(map[btcwire.ShaHash]nodeStatus),
+		depNodes: make(map[btcwire.ShaHash][]*blockNode),
+	}
+}
+
+// HaveBlock returns whether or not hash is present in the in-memory chain
+// graph, regardless of whether it is header-only or fully stored.  This
+// includes main chain and side chain nodes.
+//
+// This function is safe for concurrent access.
+func (bi *blockIndex) HaveBlock(hash *btcwire.ShaHash) bool {
+	bi.RLock()
+	_, ok := bi.index[*hash]
+	bi.RUnlock()
+	return ok
+}
+
+// haveData returns whether or not the full block for hash has been
+// downloaded and stored, as opposed to only being known via its header.
+//
+// This function is safe for concurrent access.
+func (bi *blockIndex) haveData(hash *btcwire.ShaHash) bool {
+	bi.RLock()
+	status, ok := bi.status[*hash]
+	bi.RUnlock()
+	return ok && status == statusDataStored
+}
+
+// lookupNode returns the node for hash and whether or not it was found.
+//
+// This function is safe for concurrent access.
+func (bi *blockIndex) lookupNode(hash *btcwire.ShaHash) (*blockNode, bool) {
+	bi.RLock()
+	node, ok := bi.index[*hash]
+	bi.RUnlock()
+	return node, ok
+}
+
+// addNode inserts node into the index and marks it as fully stored.  If the
+// node previously existed as a header-only entry, it is upgraded in place.
+//
+// This function is safe for concurrent access.
+func (bi *blockIndex) addNode(node *blockNode) {
+	bi.Lock()
+	bi.index[*node.hash] = node
+	bi.status[*node.hash] = statusDataStored
+	if node.parent != nil {
+		bi.depNodes[*node.parent.hash] = append(bi.depNodes[*node.parent.hash], node)
+	}
+	bi.Unlock()
+}
+
+// addHeaderOnlyNode inserts node into the index without marking it as
+// having stored block data.  It is used by the headers-first download path
+// to link validated headers into the chain graph before the matching full
+// block has arrived.
+//
+// This function is safe for concurrent access.
+func (bi *blockIndex) addHeaderOnlyNode(node *blockNode) {
+	bi.Lock()
+	if _, exists := bi.index[*node.hash]; !exists {
+		bi.index[*node.hash] = node
+		bi.status[*node.hash] = statusHeaderOnly
+	}
+	bi.Unlock()
+}
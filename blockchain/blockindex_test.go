@@ -0,0 +1,79 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/ppcsuite/btcwire"
+)
+
+func shaHashFromByte(b byte) *btcwire.ShaHash {
+	var hash btcwire.ShaHash
+	hash[0] = b
+	return &hash
+}
+
+// TestBlockIndexHeaderOnlyThenUpgraded covers the split blockExists /
+// blockConnectable rely on: a hash linked in via addHeaderOnlyNode is known
+// to the chain graph but has no stored data, and a later addNode call for the
+// same hash upgrades it to fully stored in place.
+func TestBlockIndexHeaderOnlyThenUpgraded(t *testing.T) {
+	bi := newBlockIndex()
+	hash := shaHashFromByte(1)
+	node := &blockNode{hash: hash, height: 1}
+
+	bi.addHeaderOnlyNode(node)
+
+	if !bi.HaveBlock(hash) {
+		t.Fatal("expected header-only node to be known to the chain graph")
+	}
+	if bi.haveData(hash) {
+		t.Fatal("expected header-only node to not have data stored")
+	}
+	got, ok := bi.lookupNode(hash)
+	if !ok || got != node {
+		t.Fatal("expected lookupNode to return the header-only node")
+	}
+
+	bi.addNode(node)
+
+	if !bi.haveData(hash) {
+		t.Fatal("expected node to have data stored after addNode")
+	}
+}
+
+// TestBlockIndexAddHeaderOnlyNodeDoesNotDowngradeStoredNode ensures a
+// headers-first re-announcement of a hash that already has its full block
+// data stored cannot regress its status back to header-only.
+func TestBlockIndexAddHeaderOnlyNodeDoesNotDowngradeStoredNode(t *testing.T) {
+	bi := newBlockIndex()
+	hash := shaHashFromByte(2)
+	node := &blockNode{hash: hash, height: 1}
+
+	bi.addNode(node)
+	bi.addHeaderOnlyNode(node)
+
+	if !bi.haveData(hash) {
+		t.Fatal("expected addHeaderOnlyNode to leave a stored node's status alone")
+	}
+}
+
+// TestBlockIndexUnknownHash ensures queries about a hash the index has never
+// seen come back negative rather than panicking on the missing map entries.
+func TestBlockIndexUnknownHash(t *testing.T) {
+	bi := newBlockIndex()
+	hash := shaHashFromByte(3)
+
+	if bi.HaveBlock(hash) {
+		t.Fatal("expected unknown hash to not be reported as known")
+	}
+	if bi.haveData(hash) {
+		t.Fatal("expected unknown hash to not be reported as having data")
+	}
+	if _, ok := bi.lookupNode(hash); ok {
+		t.Fatal("expected lookupNode to fail for an unknown hash")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ppcsuite/btcwire"
+)
+
+// ppcStakeTimestampMask enforces the peercoin rule that block (and, for our
+// purposes, header) timestamps must be aligned to a 16 second granularity.
+// It is the only proof-of-stake-related property a bare header can be
+// checked against; the coinstake transaction itself is only available once
+// the full block arrives, which is why checkBlockProofOfStake still runs
+// unconditionally in maybeAcceptBlock.
+const ppcStakeTimestampMask = 0xf
+
+// headersFirstState tracks the progress of a headers-first initial block
+// download.  The peer layer drives this state by feeding header-only block
+// headers to ProcessBlockHeader as they arrive, validating PoW/PoS header
+// linkage, timestamp ordering, and checkpoint matches only.  Once the header
+// chain reaches the final checkpoint, full blocks are requested and fed into
+// ProcessBlock with BFFastAdd set so maybeAcceptBlock can skip the checks
+// already proven true by the header chain.
+type headersFirstState struct {
+	sync.RWMutex
+
+	// headersTip is the hash of the most recently validated header.  It
+	// is nil until the first header has been processed.
+	headersTip *btcwire.ShaHash
+
+	// headersTipHeight is the height that corresponds to headersTip.
+	headersTipHeight int64
+
+	// headersTipTime is the timestamp claimed by headersTip, used to
+	// enforce that each subsequent header's timestamp moves forward.
+	headersTipTime time.Time
+
+	// finalCheckpointHeight is the height of the last hard-coded
+	// checkpoint.  The header chain is required to match the checkpoint
+	// hash at this height; once full blocks have also been backfilled up
+	// to it, the chain is considered current.
+	finalCheckpointHeight int64
+
+	// current is true once full blocks have been backfilled up to
+	// finalCheckpointHeight.
+	current bool
+}
+
+// IsCurrent returns whether or not the chain believes it is synced with the
+// rest of the network, as tracked by the headers-first state machine.  It
+// stays false until a headers-first sync has been started and full blocks
+// have been backfilled up to the final checkpoint height.  A chain that has
+// never run a headers-first sync always reports false.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) IsCurrent() bool {
+	b.hdrState.RLock()
+	defer b.hdrState.RUnlock()
+	return b.hdrState.current
+}
+
+// HeadersTip returns the hash of the most recently validated header, or nil
+// if no headers-first sync has been started.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) HeadersTip() *btcwire.ShaHash {
+	b.hdrState.RLock()
+	defer b.hdrState.RUnlock()
+	return b.hdrState.headersTip
+}
+
+// DownloadProgress returns the fraction, in the range [0.0, 1.0], of the
+// final checkpoint height reached by the header-only chain so far.  It
+// returns 1.0 once there is no further checkpoint to sync against.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) DownloadProgress() float64 {
+	b.hdrState.RLock()
+	defer b.hdrState.RUnlock()
+	finalHeight := b.hdrState.finalCheckpointHeight
+	if finalHeight == 0 {
+		// No header has been processed yet, so read the final
+		// checkpoint height from the configured checkpoints.
+		if checkpoints := b.netParams.Checkpoints; len(checkpoints) > 0 {
+			finalHeight = checkpoints[len(checkpoints)-1].Height
+		}
+	}
+	if finalHeight == 0 || b.hdrState.headersTipHeight >= finalHeight {
+		return 1.0
+	}
+	return float64(b.hdrState.headersTipHeight) / float64(finalHeight)
+}
+
+// ProcessBlockHeader is the headers-first counterpart to ProcessBlock.  It
+// validates that the header connects to the current headers tip, checks
+// proof-of-work and proof-of-stake header linkage and timestamp ordering,
+// and, once the final checkpoint height is reached, that the header matches
+// the expected checkpoint hash.  Unlike ProcessBlock it never touches
+// transaction data, so script execution and duplicate-tx checks never apply
+// here; those are deferred to ProcessBlock with BFFastAdd set once the full
+// block for a height at or below the final checkpoint arrives.
+func (b *BlockChain) ProcessBlockHeader(header *btcwire.BlockHeader, timeSource MedianTimeSource) error {
+	headerHash := header.BlockSha()
+
+	b.hdrState.Lock()
+	defer b.hdrState.Unlock()
+
+	if b.hdrState.headersTip != nil && !header.PrevBlock.IsEqual(b.hdrState.headersTip) {
+		str := fmt.Sprintf("header %v does not connect to current headers "+
+			"tip %v", headerHash, b.hdrState.headersTip)
+		return ruleError(ErrHeaderDoesNotConnect, str)
+	}
+
+	// Timestamp ordering: each header must claim a time strictly after
+	// its parent, and not further in the future than the network
+	// tolerates.
+	if !b.hdrState.headersTipTime.IsZero() && !header.Timestamp.After(b.hdrState.headersTipTime) {
+		str := fmt.Sprintf("header %v has timestamp %v which is not after "+
+			"the previous header's timestamp %v", headerHash,
+			header.Timestamp, b.hdrState.headersTipTime)
+		return ruleError(ErrTimeTooOld, str)
+	}
+	maxTimestamp := timeSource.AdjustedTime().Add(maxTimeOffsetSeconds * time.Second)
+	if header.Timestamp.After(maxTimestamp) {
+		str := fmt.Sprintf("header %v has timestamp %v too far in the future",
+			headerHash, header.Timestamp)
+		return ruleError(ErrTimeTooNew, str)
+	}
+
+	// ppc: proof-of-stake linkage.  The coinstake transaction itself
+	// cannot be checked until the full block arrives, but the timestamp
+	// granularity peercoin requires of every block is a property of the
+	// header alone and can be enforced here.
+	if header.Timestamp.Unix()&ppcStakeTimestampMask != 0 {
+		str := fmt.Sprintf("header %v timestamp %v is not aligned to the "+
+			"stake timestamp mask", headerHash, header.Timestamp)
+		return ruleError(ErrPoSMisalignedTimestamp, str)
+	}
+
+	// Proof of work: the claimed target must be within the network's
+	// limit and the header hash must actually meet it.
+	target := CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(b.netParams.PowLimit) > 0 {
+		str := fmt.Sprintf("header %v target difficulty of %064x is too low",
+			headerHash, target)
+		return ruleError(ErrUnexpectedDifficulty, str)
+	}
+	if ShaHashToBig(&headerHash).Cmp(target) > 0 {
+		str := fmt.Sprintf("header hash %v is higher than expected max of %064x",
+			headerHash, target)
+		return ruleError(ErrHighHash, str)
+	}
+
+	newHeight := b.hdrState.headersTipHeight + 1
+	if checkpoints := b.netParams.Checkpoints; len(checkpoints) > 0 {
+		last := checkpoints[len(checkpoints)-1]
+		b.hdrState.finalCheckpointHeight = last.Height
+		if newHeight == last.Height && !headerHash.IsEqual(last.Hash) {
+			str := fmt.Sprintf("header at height %d does not match "+
+				"checkpoint hash %v", newHeight, last.Hash)
+			return ruleError(ErrCheckpointMismatch, str)
+		}
+	}
+
+	// Link the header into the chain graph as a header-only stub so the
+	// chain can recognize it as connectable once a full block claiming
+	// it as a parent arrives, without treating it as fully downloaded.
+	node := ppcNewBlockNode(header, &headerHash, newHeight, nil) // ppc: no meta until the body arrives
+	if parent, ok := b.index.lookupNode(&header.PrevBlock); ok {
+		node.parent = parent
+		node.workSum.Add(parent.workSum, node.workSum)
+	}
+	b.index.addHeaderOnlyNode(node)
+
+	b.hdrState.headersTip = &headerHash
+	b.hdrState.headersTipHeight = newHeight
+	b.hdrState.headersTipTime = header.Timestamp
+	return nil
+}
+
+// markBackfillComplete flags the headers-first state machine as current once
+// the block backfill has caught up to the final checkpoint height.  It is
+// called from maybeAcceptBlock as blocks below the checkpoint are accepted
+// with BFFastAdd set.
+//
+// BFFastAdd is also set by bulk-import paths that never ran a headers-first
+// sync (the addblock utility, test harnesses re-feeding known-good blocks),
+// where finalCheckpointHeight is still its zero value.  Guard on a sync
+// actually having started so those imports don't cause IsCurrent to flip to
+// true after the first block.
+func (b *BlockChain) markBackfillComplete(height int64) {
+	b.hdrState.Lock()
+	defer b.hdrState.Unlock()
+	if b.hdrState.headersTip == nil {
+		return
+	}
+	if height >= b.hdrState.finalCheckpointHeight {
+		b.hdrState.current = true
+	}
+}
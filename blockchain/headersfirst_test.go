@@ -0,0 +1,177 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ppcsuite/btcwire"
+	"github.com/ppcsuite/ppcd/chaincfg"
+)
+
+// fakeTimeSource is a trivial MedianTimeSource stub that always reports a
+// fixed adjusted time, so tests don't depend on wall-clock time.
+type fakeTimeSource struct {
+	adjusted time.Time
+}
+
+func (f fakeTimeSource) AdjustedTime() time.Time { return f.adjusted }
+
+// maxCompactTarget is a compact "bits" value whose target, the mantissa
+// 0x7fffff shifted left by 30 bytes, is larger than any 256-bit hash.  The
+// mantissa's high bit is the sign bit in this encoding, so it is left clear
+// to keep the target positive.  Using it as both a test chain's PoW limit
+// and every header's claimed difficulty means the proof-of-work check in
+// ProcessBlockHeader passes for any header hash, without the test having to
+// actually mine a header.
+const maxCompactTarget = 0x217fffff
+
+func newTestBlockChain() *BlockChain {
+	return &BlockChain{
+		netParams: &chaincfg.Params{
+			PowLimit: CompactToBig(maxCompactTarget),
+		},
+		index: newBlockIndex(),
+	}
+}
+
+// TestProcessBlockHeaderHeaderOnlySync drives two connecting headers through
+// ProcessBlockHeader and confirms both land in the chain graph as
+// header-only stubs with the headers tip advancing, mirroring what a
+// headers-first sync does before any block bodies arrive.
+func TestProcessBlockHeaderHeaderOnlySync(t *testing.T) {
+	b := newTestBlockChain()
+	ts := fakeTimeSource{adjusted: time.Unix(1000000100, 0)}
+
+	genesis := &btcwire.BlockHeader{
+		Timestamp: time.Unix(1000000000, 0),
+		Bits:      maxCompactTarget,
+	}
+	if err := b.ProcessBlockHeader(genesis, ts); err != nil {
+		t.Fatalf("unexpected error processing genesis header: %v", err)
+	}
+
+	genesisHash := genesis.BlockSha()
+	child := &btcwire.BlockHeader{
+		PrevBlock: genesisHash,
+		Timestamp: time.Unix(1000000016, 0),
+		Bits:      maxCompactTarget,
+	}
+	if err := b.ProcessBlockHeader(child, ts); err != nil {
+		t.Fatalf("unexpected error processing child header: %v", err)
+	}
+
+	if b.HeadersTip() == nil || !b.HeadersTip().IsEqual(shaHashPtr(child.BlockSha())) {
+		t.Fatal("expected headers tip to advance to the child header")
+	}
+
+	childHash := child.BlockSha()
+	if !b.index.HaveBlock(&childHash) {
+		t.Fatal("expected child header to be linked into the chain graph")
+	}
+	if b.index.haveData(&childHash) {
+		t.Fatal("expected child header to be header-only, no body has arrived yet")
+	}
+
+	// Backfilling the body for the genesis block, the way maybeAcceptBlock
+	// does via b.index.addNode, upgrades its entry in place rather than
+	// adding a second one.
+	node := &blockNode{hash: shaHashPtr(genesisHash), height: 0}
+	b.index.addNode(node)
+	if !b.index.haveData(&genesisHash) {
+		t.Fatal("expected genesis header to have data stored after backfill")
+	}
+}
+
+func shaHashPtr(hash btcwire.ShaHash) *btcwire.ShaHash { return &hash }
+
+// TestProcessBlockHeaderRejectsNonConnectingHeader ensures a header whose
+// PrevBlock does not match the current headers tip is rejected rather than
+// silently accepted as a fork of the header-only chain.
+func TestProcessBlockHeaderRejectsNonConnectingHeader(t *testing.T) {
+	b := newTestBlockChain()
+	b.hdrState.headersTip = shaHashPtr(btcwire.ShaHash{0xaa})
+	b.hdrState.headersTipHeight = 5
+
+	header := &btcwire.BlockHeader{
+		PrevBlock: btcwire.ShaHash{0xbb},
+		Timestamp: time.Unix(1000000000, 0),
+	}
+
+	err := b.ProcessBlockHeader(header, fakeTimeSource{adjusted: time.Unix(1000000000, 0)})
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.ErrorCode != ErrHeaderDoesNotConnect {
+		t.Fatalf("expected ErrHeaderDoesNotConnect, got %v", err)
+	}
+}
+
+// TestProcessBlockHeaderRejectsStaleTimestamp ensures a header that does not
+// move the claimed time strictly forward from its parent is rejected.
+func TestProcessBlockHeaderRejectsStaleTimestamp(t *testing.T) {
+	b := newTestBlockChain()
+	parentTime := time.Unix(1000000016, 0)
+	b.hdrState.headersTipTime = parentTime
+
+	header := &btcwire.BlockHeader{
+		Timestamp: parentTime,
+	}
+
+	err := b.ProcessBlockHeader(header, fakeTimeSource{adjusted: parentTime})
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.ErrorCode != ErrTimeTooOld {
+		t.Fatalf("expected ErrTimeTooOld, got %v", err)
+	}
+}
+
+// TestProcessBlockHeaderRejectsMisalignedStakeTimestamp ensures a header
+// whose timestamp is not aligned to the peercoin stake timestamp mask is
+// rejected, even though PrevBlock linkage and ordering are otherwise fine.
+func TestProcessBlockHeaderRejectsMisalignedStakeTimestamp(t *testing.T) {
+	b := newTestBlockChain()
+
+	misaligned := time.Unix(1000000001, 0)
+	header := &btcwire.BlockHeader{
+		Timestamp: misaligned,
+	}
+
+	err := b.ProcessBlockHeader(header, fakeTimeSource{adjusted: misaligned.Add(time.Hour)})
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.ErrorCode != ErrPoSMisalignedTimestamp {
+		t.Fatalf("expected ErrPoSMisalignedTimestamp, got %v", err)
+	}
+}
+
+// TestMarkBackfillCompleteGuardsBulkImport ensures a bulk-import path that
+// sets BFFastAdd without ever running a headers-first sync (finalCheckpointHeight
+// still zero) cannot flip IsCurrent to true on the very first imported block.
+func TestMarkBackfillCompleteGuardsBulkImport(t *testing.T) {
+	b := &BlockChain{}
+
+	b.markBackfillComplete(0)
+
+	if b.IsCurrent() {
+		t.Fatal("expected IsCurrent to stay false when no headers-first sync ever started")
+	}
+}
+
+// TestMarkBackfillCompleteFlipsCurrentAfterSync ensures that once a
+// headers-first sync has actually started, reaching the final checkpoint
+// height during backfill does mark the chain current.
+func TestMarkBackfillCompleteFlipsCurrentAfterSync(t *testing.T) {
+	b := &BlockChain{}
+	b.hdrState.headersTip = shaHashPtr(btcwire.ShaHash{0xcc})
+	b.hdrState.finalCheckpointHeight = 10
+
+	b.markBackfillComplete(9)
+	if b.IsCurrent() {
+		t.Fatal("expected IsCurrent to stay false before the final checkpoint height")
+	}
+
+	b.markBackfillComplete(10)
+	if !b.IsCurrent() {
+		t.Fatal("expected IsCurrent to flip to true once backfill reaches the final checkpoint height")
+	}
+}
@@ -32,15 +32,43 @@ const (
 	// without modifying the current state.
 	BFDryRun
 
+	// BFHeaderValidated may be set to indicate the block's header has
+	// already been fully verified against the header chain during a
+	// headers-first download (PoW/PoS linkage, timestamp ordering, and
+	// checkpoint matching).  maybeAcceptBlock and checkBlockContext use
+	// this to avoid repeating those header-level checks, though
+	// checkBlockProofOfStake is still run since the coinstake transaction
+	// itself is not available until the full block arrives.
+	BFHeaderValidated
+
+	// BFNoDupBlockCheck may be set to skip the blockExists lookup at the
+	// top of ProcessBlock that guards against reprocessing a block the
+	// chain already has.  It exists for trusted re-submission paths,
+	// namely the orphan pool resubmitting a block whose parent just
+	// landed, and bulk-import test harnesses re-feeding known-good
+	// blocks, where the caller has already proven the block is not a
+	// duplicate and the extra database hit is measurable during import.
+	//
+	// Misuse of this flag can corrupt chain state: if the block actually
+	// is a duplicate, skipping the check lets it run through acceptance a
+	// second time, and neither maybeAcceptBlock nor connectBestChain
+	// guard against that on either the main chain or side chain path.
+	// Only set this when the caller is certain, such as the orphan pool
+	// resubmitting a block it just removed from its own bookkeeping.
+	BFNoDupBlockCheck
+
 	// BFNone is a convenience value to specifically indicate no flags.
 	BFNone BehaviorFlags = 0
 )
 
-// blockExists determines whether a block with the given hash exists either in
-// the main chain or any side chains.
+// blockExists determines whether the full data for a block with the given
+// hash has already been downloaded and stored, either in the in-memory
+// chain graph or the block database.  A hash that is only known via its
+// header (for example, one linked in by headers-first sync but not yet
+// backfilled) does not count; use blockConnectable for that.
 func (b *BlockChain) blockExists(hash *btcwire.ShaHash) (bool, error) {
 	// Check memory chain first (could be main chain or side chain blocks).
-	if _, ok := b.index[*hash]; ok {
+	if b.index.haveData(hash) {
 		return true, nil
 	}
 
@@ -48,117 +76,86 @@ func (b *BlockChain) blockExists(hash *btcwire.ShaHash) (bool, error) {
 	return b.db.ExistsSha(hash)
 }
 
-// processOrphans determines if there are any orphans which depend on the passed
-// block hash (they are no longer orphans if true) and potentially accepts them.
-// It repeats the process for the newly accepted blocks (to detect further
-// orphans which may no longer be orphans) until there are no more.
-//
-// The flags do not modify the behavior of this function directly, however they
-// are needed to pass along to maybeAcceptBlock.
-func (b *BlockChain) processOrphans(hash *btcwire.ShaHash, timeSource MedianTimeSource, flags BehaviorFlags) error {
-
-	defer timeTrack(now(), fmt.Sprintf("processOrphans(%v)", hash))
-
-	// Start with processing at least the passed hash.  Leave a little room
-	// for additional orphan blocks that need to be processed without
-	// needing to grow the array in the common case.
-	processHashes := make([]*btcwire.ShaHash, 0, 10)
-	processHashes = append(processHashes, hash)
-	for len(processHashes) > 0 {
-		// Pop the first hash to process from the slice.
-		processHash := processHashes[0]
-		processHashes[0] = nil // Prevent GC leak.
-		processHashes = processHashes[1:]
-
-		// Look up all orphans that are parented by the block we just
-		// accepted.  This will typically only be one, but it could
-		// be multiple if multiple blocks are mined and broadcast
-		// around the same time.  The one with the most proof of work
-		// will eventually win out.  An indexing for loop is
-		// intentionally used over a range here as range does not
-		// reevaluate the slice on each iteration nor does it adjust the
-		// index for the modified slice.
-		for i := 0; i < len(b.prevOrphans[*processHash]); i++ {
-			orphan := b.prevOrphans[*processHash][i]
-			if orphan == nil {
-				log.Warnf("Found a nil entry at index %d in the "+
-					"orphan dependency list for block %v", i,
-					processHash)
-				continue
-			}
-
-			// Remove the orphan from the orphan pool.
-			// It's safe to ignore the error on Sha since the hash
-			// is already cached.
-			orphanHash, _ := orphan.block.Sha()
-			b.removeOrphanBlock(orphan)
-			i--
-
-			// ppc: processing
-			b.ppcOrphanBlockRemoved(orphan.block)
-
-			// Potentially accept the block into the block chain.
-			err := b.maybeAcceptBlock(orphan.block, timeSource, flags)
-			if err != nil {
-				return err
-			}
-
-			// Add this block to the list of blocks to process so
-			// any orphan blocks that depend on this block are
-			// handled too.
-			processHashes = append(processHashes, orphanHash)
-		}
+// blockConnectable determines whether the given hash is known to the
+// in-memory chain graph or the block database, regardless of whether the
+// corresponding block's data has actually been downloaded.  This is what
+// lets a block whose parent is only a header-first stub still be treated as
+// connectable, as opposed to orphaned.
+func (b *BlockChain) blockConnectable(hash *btcwire.ShaHash) (bool, error) {
+	if b.index.HaveBlock(hash) {
+		return true, nil
 	}
-	return nil
+
+	return b.db.ExistsSha(hash)
+}
+
+// HaveBlock returns whether or not the chain instance has the full data for
+// the block represented by the passed hash.  This includes checking the
+// main chain, any side chains, and the block database.  It does not
+// consider blocks buffered by an external orphan pool, since the chain
+// itself no longer tracks those.
+//
+// This function is exported so callers that sit in front of ProcessBlock,
+// such as an orphan pool, can cheaply avoid resubmitting blocks the chain
+// already knows about.
+func (b *BlockChain) HaveBlock(hash *btcwire.ShaHash) (bool, error) {
+	return b.blockExists(hash)
 }
 
 // ProcessBlock is the main workhorse for handling insertion of new blocks into
 // the block chain.  It includes functionality such as rejecting duplicate
-// blocks, ensuring blocks follow all rules, orphan handling, and insertion into
-// the block chain along with best chain selection and reorganization.
+// blocks, ensuring blocks follow all rules, and insertion into the block
+// chain along with best chain selection and reorganization.
+//
+// Blocks whose parent is not already known to the chain are rejected with
+// ErrMissingParent rather than being buffered internally; callers that want
+// orphan buffering and resubmission should sit in front of ProcessBlock, for
+// example the orphan pool used by the peer/sync layer.
 //
-// It returns a bool which indicates whether or not the block is an orphan and
-// any errors that occurred during processing.  The returned bool is only valid
-// when the error is nil.
-func (b *BlockChain) ProcessBlock(block *btcutil.Block, timeSource MedianTimeSource, flags BehaviorFlags) (bool, error) {
+// It returns whether or not the block ended up on the main chain, either
+// directly or via a reorganization that made it the new best tip, as opposed
+// to a side chain, and whether or not the block is an orphan, along with any
+// errors that occurred during processing.  Since blocks with an unknown
+// parent are rejected with ErrMissingParent, the orphan bool is always false.
+// The returned bools are only valid when the error is nil.
+func (b *BlockChain) ProcessBlock(block *btcutil.Block, timeSource MedianTimeSource, flags BehaviorFlags) (bool, bool, error) {
 
 	defer timeTrack(now(), fmt.Sprintf("ProcessBlock(%v)", slice(block.Sha())[0]))
 
 	fastAdd := flags&BFFastAdd == BFFastAdd
 	dryRun := flags&BFDryRun == BFDryRun
+	noDupCheck := flags&BFNoDupBlockCheck == BFNoDupBlockCheck
 
 	blockHash, err := block.Sha()
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 	log.Tracef("Processing block %v", blockHash)
 
-	// The block must not already exist in the main chain or side chains.
-	exists, err := b.blockExists(blockHash)
-	if err != nil {
-		return false, err
-	}
-	if exists {
-		str := fmt.Sprintf("already have block %v", blockHash)
-		return false, ruleError(ErrDuplicateBlock, str)
-	}
-
-	// The block must not already exist as an orphan.
-	if _, exists := b.orphans[*blockHash]; exists {
-		str := fmt.Sprintf("already have block (orphan) %v", blockHash)
-		return false, ruleError(ErrDuplicateBlock, str)
+	// The block must not already exist in the main chain or side chains,
+	// unless the caller has set BFNoDupBlockCheck to assert it has
+	// already proven that for us.
+	if !noDupCheck {
+		exists, err := b.blockExists(blockHash)
+		if err != nil {
+			return false, false, err
+		}
+		if exists {
+			str := fmt.Sprintf("already have block %v", blockHash)
+			return false, false, ruleError(ErrDuplicateBlock, str)
+		}
 	}
 
 	// ppc: processing
 	ppcErr := b.ppcProcessBlock(block, phasePreSanity)
 	if ppcErr != nil {
-		return false, ppcErr
+		return false, false, ppcErr
 	}
 
 	// Perform preliminary sanity checks on the block and its transactions.
 	err = checkBlockSanity(b.netParams, block, b.netParams.PowLimit, timeSource, flags)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 
 	// Find the previous checkpoint and perform some additional checks based
@@ -170,7 +167,7 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, timeSource MedianTimeSou
 	blockHeader := &block.MsgBlock().Header
 	checkpointBlock, err := b.findPreviousCheckpoint()
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 	if checkpointBlock != nil {
 		// Ensure the block timestamp is after the checkpoint timestamp.
@@ -180,7 +177,7 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, timeSource MedianTimeSou
 			str := fmt.Sprintf("block %v has timestamp %v before "+
 				"last checkpoint timestamp %v", blockHash,
 				blockHeader.Timestamp, checkpointTime)
-			return false, ruleError(ErrCheckpointTimeTooOld, str)
+			return false, false, ruleError(ErrCheckpointTimeTooOld, str)
 		}
 		if !fastAdd {
 			// Even though the checks prior to now have already ensured the
@@ -198,52 +195,39 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, timeSource MedianTimeSou
 				str := fmt.Sprintf("block target difficulty of %064x "+
 					"is too low when compared to the previous "+
 					"checkpoint", currentTarget)
-				return false, ruleError(ErrDifficultyTooLow, str)
+				return false, false, ruleError(ErrDifficultyTooLow, str)
 			}*/
 		}
 	}
 
-	// Handle orphan blocks.
+	// The block must connect to a block we already know about, even if
+	// that ancestor is itself only a header-first stub whose body has
+	// not arrived yet.  Blocks whose parent is unknown are rejected
+	// outright; a pool sitting in front of this function is expected to
+	// catch ErrMissingParent, buffer the block, and resubmit it once its
+	// ancestor lands.
 	prevHash := &blockHeader.PrevBlock
 	if !prevHash.IsEqual(zeroHash) {
-		prevHashExists, err := b.blockExists(prevHash)
+		prevHashConnectable, err := b.blockConnectable(prevHash)
 		if err != nil {
-			return false, err
+			return false, false, err
 		}
-		if !prevHashExists {
-			if !dryRun {
-				// ppc: processing
-				ppcErr := b.ppcProcessOrphan(block)
-				if ppcErr != nil {
-					return false, ppcErr
-				}
-				log.Infof("Adding orphan block %v with parent %v",
-					blockHash, prevHash)
-				b.addOrphanBlock(block)
-			}
-			return true, nil
+		if !prevHashConnectable {
+			str := fmt.Sprintf("previous block %v is not known", prevHash)
+			return false, false, ruleError(ErrMissingParent, str)
 		}
 	}
 
 	// The block has passed all context independent checks and appears sane
 	// enough to potentially accept it into the block chain.
-	err = b.maybeAcceptBlock(block, timeSource, flags)
+	isMainChain, err := b.maybeAcceptBlock(block, timeSource, flags)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 
-	// Don't process any orphans or log when the dry run flag is set.
 	if !dryRun {
-		// Accept any orphan blocks that depend on this block (they are
-		// no longer orphans) and repeat for those accepted blocks until
-		// there are no more.
-		err := b.processOrphans(blockHash, timeSource, flags)
-		if err != nil {
-			return false, err
-		}
-
 		log.Debugf("Accepted block %v", blockHash)
 	}
 
-	return false, nil
+	return isMainChain, false, nil
 }
@@ -0,0 +1,309 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package orphanpool buffers blocks whose parent has not been seen yet and
+// resubmits them once their ancestor is accepted.  Orphan handling used to
+// live inside blockchain.BlockChain itself; it was moved here so the chain
+// only has to reason about blocks it can connect, and so the peer/server
+// layer can tune and inspect orphan buffering independently of consensus.
+package orphanpool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ppcsuite/btcutil"
+	"github.com/ppcsuite/btcwire"
+	"github.com/ppcsuite/ppcd/blockchain"
+)
+
+const (
+	// defaultMaxOrphanBlocks is the default maximum number of orphan
+	// blocks the pool will hold onto at once.  Once exceeded, the oldest
+	// orphan is evicted to make room for the new one.
+	defaultMaxOrphanBlocks = 100
+
+	// defaultOrphanExpiration is the default length of time an orphan is
+	// kept before it is considered stale and purged.
+	defaultOrphanExpiration = time.Hour
+)
+
+// Chain is the interface the pool needs from the consensus layer.  It is
+// satisfied by *blockchain.BlockChain.
+type Chain interface {
+	// HaveBlock reports whether the chain already knows about the block
+	// with the given hash, either in the main chain, a side chain, or
+	// the block database.
+	HaveBlock(hash *btcwire.ShaHash) (bool, error)
+
+	// ProcessBlock attempts to insert the block into the chain.  It
+	// returns blockchain.ErrMissingParent when the block's parent is not
+	// yet known.
+	ProcessBlock(block *btcutil.Block, timeSource blockchain.MedianTimeSource, flags blockchain.BehaviorFlags) (bool, bool, error)
+}
+
+// MetadataHook lets callers track peercoin-specific side state for blocks
+// that pass through the pool, mirroring the bookkeeping the ppc* hooks used
+// to perform inside blockchain itself.
+type MetadataHook interface {
+	// OrphanAdded is called before a block is buffered as an orphan and
+	// may reject it, mirroring the gate the old ppcProcessOrphan hook
+	// used to provide when it ran ahead of blockchain buffering the
+	// orphan internally.  Returning a non-nil error aborts the block
+	// without buffering it, and that error is surfaced to the original
+	// ProcessBlock caller.
+	OrphanAdded(block *btcutil.Block) error
+
+	// OrphanRemoved is called when a buffered orphan is removed, whether
+	// because it is being resubmitted, evicted, or expired.
+	OrphanRemoved(block *btcutil.Block)
+}
+
+// orphanBlock represents a block that could not be connected to the chain
+// because its parent is unknown, along with the time at which it should be
+// purged if it is never claimed.
+type orphanBlock struct {
+	block      *btcutil.Block
+	expiration time.Time
+}
+
+// Pool buffers orphan blocks and resubmits them to the chain once their
+// ancestor is accepted.  It is safe for concurrent use.
+type Pool struct {
+	mtx sync.Mutex
+
+	chain Chain
+	hook  MetadataHook
+
+	maxOrphans int
+	expiration time.Duration
+
+	orphans     map[btcwire.ShaHash]*orphanBlock
+	prevOrphans map[btcwire.ShaHash][]*orphanBlock
+}
+
+// New returns a new orphan pool that resubmits buffered blocks to chain.
+// hook may be nil if no peercoin-specific metadata needs to be tracked.
+func New(chain Chain, hook MetadataHook) *Pool {
+	return &Pool{
+		chain:       chain,
+		hook:        hook,
+		maxOrphans:  defaultMaxOrphanBlocks,
+		expiration:  defaultOrphanExpiration,
+		orphans:     make(map[btcwire.ShaHash]*orphanBlock),
+		prevOrphans: make(map[btcwire.ShaHash][]*orphanBlock),
+	}
+}
+
+// ProcessBlock submits block to the chain.  If the chain reports that the
+// block's parent is missing, the block is buffered as an orphan instead of
+// the error being returned to the caller.  Once an ancestor of a buffered
+// orphan is accepted, the orphan (and, transitively, any of its own
+// children) is automatically resubmitted.
+//
+// It returns whether or not the block ended up on the main chain and
+// whether or not it was buffered as an orphan, matching the semantics
+// blockchain.BlockChain.ProcessBlock used to provide on its own.
+func (p *Pool) ProcessBlock(block *btcutil.Block, timeSource blockchain.MedianTimeSource, flags blockchain.BehaviorFlags) (bool, bool, error) {
+	blockHash, err := block.Sha()
+	if err != nil {
+		return false, false, err
+	}
+
+	p.mtx.Lock()
+	if _, exists := p.orphans[*blockHash]; exists {
+		p.mtx.Unlock()
+		str := fmt.Sprintf("already have block (orphan) %v", blockHash)
+		return false, false, blockchain.RuleError{
+			ErrorCode:   blockchain.ErrDuplicateBlock,
+			Description: str,
+		}
+	}
+	p.mtx.Unlock()
+
+	isMainChain, isOrphan, err := p.chain.ProcessBlock(block, timeSource, flags)
+	if err != nil {
+		if !isMissingParent(err) {
+			return false, false, err
+		}
+
+		if err := p.addOrphanBlock(block); err != nil {
+			return false, false, err
+		}
+		return false, true, nil
+	}
+
+	if isOrphan {
+		// The chain itself no longer buffers orphans, but is left in
+		// place defensively in case a future Chain implementation
+		// still reports them directly.
+		if err := p.addOrphanBlock(block); err != nil {
+			return false, false, err
+		}
+		return false, true, nil
+	}
+
+	mainChain, err := p.processOrphans(blockHash, timeSource, flags)
+	if err != nil {
+		return false, false, err
+	}
+	if mainChain {
+		isMainChain = true
+	}
+
+	return isMainChain, false, nil
+}
+
+// isMissingParent reports whether err is the blockchain.ErrMissingParent
+// rule error.
+func isMissingParent(err error) bool {
+	ruleErr, ok := err.(blockchain.RuleError)
+	return ok && ruleErr.ErrorCode == blockchain.ErrMissingParent
+}
+
+// addOrphanBlock adds the passed block to the orphan pool, evicting the
+// oldest entry if the pool is already at capacity and purging any entries
+// that have expired.  It consults the metadata hook, if any, before
+// buffering the block so peercoin-specific validation can still reject an
+// orphan outright the way ppcProcessOrphan used to.
+func (p *Pool) addOrphanBlock(block *btcutil.Block) error {
+	if p.hook != nil {
+		if err := p.hook.OrphanAdded(block); err != nil {
+			return err
+		}
+	}
+
+	p.mtx.Lock()
+
+	// Purge any expired orphans and track the oldest surviving entry in
+	// case eviction is needed below.  The oldest entry is recomputed on
+	// every call instead of being cached across calls, since a cached
+	// key can end up referring to an orphan that was since evicted or
+	// resubmitted, which would otherwise panic on the next lookup.
+	now := time.Now()
+	var oldest *orphanBlock
+	var removed []*btcutil.Block
+	for _, orphan := range p.orphans {
+		if now.After(orphan.expiration) {
+			p.removeOrphanBlock(orphan)
+			removed = append(removed, orphan.block)
+			continue
+		}
+		if oldest == nil || orphan.expiration.Before(oldest.expiration) {
+			oldest = orphan
+		}
+	}
+
+	if len(p.orphans) >= p.maxOrphans && p.maxOrphans > 0 && oldest != nil {
+		p.removeOrphanBlock(oldest)
+		removed = append(removed, oldest.block)
+	}
+
+	blockHash, _ := block.Sha()
+	orphan := &orphanBlock{
+		block:      block,
+		expiration: now.Add(p.expiration),
+	}
+	p.orphans[*blockHash] = orphan
+
+	prevHash := &block.MsgBlock().Header.PrevBlock
+	p.prevOrphans[*prevHash] = append(p.prevOrphans[*prevHash], orphan)
+
+	p.mtx.Unlock()
+
+	p.notifyOrphansRemoved(removed)
+
+	return nil
+}
+
+// removeOrphanBlock removes the passed orphan from the pool's bookkeeping.
+// The caller must hold p.mtx.
+//
+// It does not invoke MetadataHook.OrphanRemoved: that call can run back into
+// the pool, so callers must fire it themselves once p.mtx is released rather
+// than risk a deadlock by calling it from here.
+func (p *Pool) removeOrphanBlock(orphan *orphanBlock) {
+	orphanHash, _ := orphan.block.Sha()
+	delete(p.orphans, *orphanHash)
+
+	prevHash := &orphan.block.MsgBlock().Header.PrevBlock
+	orphans := p.prevOrphans[*prevHash]
+	for i, o := range orphans {
+		if o == orphan {
+			orphans = append(orphans[:i], orphans[i+1:]...)
+			break
+		}
+	}
+	if len(orphans) == 0 {
+		delete(p.prevOrphans, *prevHash)
+	} else {
+		p.prevOrphans[*prevHash] = orphans
+	}
+}
+
+// notifyOrphansRemoved fires MetadataHook.OrphanRemoved for each of the given
+// blocks.  It must be called with p.mtx NOT held, matching the OrphanAdded
+// call in addOrphanBlock: a hook that calls back into the pool would
+// otherwise deadlock on p.mtx.
+func (p *Pool) notifyOrphansRemoved(blocks []*btcutil.Block) {
+	if p.hook == nil {
+		return
+	}
+	for _, block := range blocks {
+		p.hook.OrphanRemoved(block)
+	}
+}
+
+// processOrphans resubmits any orphans that are parented by hash, and
+// repeats the process for their children, until no more become eligible.
+// It mirrors the traversal blockchain.processOrphans used to perform
+// internally before orphan handling moved into this package.
+//
+// The returned bool is true if any resubmitted orphan, not just the last one
+// processed, ended up on the main chain, so a batch that both extends the
+// main chain and drops a sibling onto a side chain is still reported
+// correctly to the caller.
+func (p *Pool) processOrphans(hash *btcwire.ShaHash, timeSource blockchain.MedianTimeSource, flags blockchain.BehaviorFlags) (bool, error) {
+	isMainChain := false
+
+	processHashes := make([]*btcwire.ShaHash, 0, 10)
+	processHashes = append(processHashes, hash)
+	for len(processHashes) > 0 {
+		processHash := processHashes[0]
+		processHashes[0] = nil
+		processHashes = processHashes[1:]
+
+		p.mtx.Lock()
+		children := make([]*orphanBlock, len(p.prevOrphans[*processHash]))
+		copy(children, p.prevOrphans[*processHash])
+		p.mtx.Unlock()
+
+		for _, orphan := range children {
+			p.mtx.Lock()
+			p.removeOrphanBlock(orphan)
+			p.mtx.Unlock()
+
+			p.notifyOrphansRemoved([]*btcutil.Block{orphan.block})
+
+			orphanHash, _ := orphan.block.Sha()
+
+			// The pool just removed this block from its own
+			// bookkeeping and is resubmitting it for the first
+			// time, so it can assert it is not a duplicate and
+			// skip the chain's own lookup.
+			mainChain, _, err := p.chain.ProcessBlock(orphan.block, timeSource,
+				flags|blockchain.BFNoDupBlockCheck)
+			if err != nil {
+				return false, err
+			}
+			if mainChain {
+				isMainChain = true
+			}
+
+			processHashes = append(processHashes, orphanHash)
+		}
+	}
+	return isMainChain, nil
+}